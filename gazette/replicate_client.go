@@ -3,6 +3,7 @@ package gazette
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"net/url"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -27,17 +29,43 @@ const (
 	FragmentLocationHeader = "X-Fragment-Location"
 	WriteHeadHeader        = "X-Write-Head"
 
+	// AbortReasonHeader is set alongside a zero CommitDeltaHeader when a
+	// commit is abandoned before the peer's response is known, so the
+	// peer can distinguish a deliberate abort from a truncated stream.
+	AbortReasonHeader = "X-Abort-Reason"
+
+	// ReplicateClientIdlePoolSize bounds the HTTP/1.1 idle socket pool
+	// kept per peer. Under NewReplicateClientHTTP2 it instead bounds the
+	// number of pooled HTTP/2 connections maintained per peer, each of
+	// which multiplexes many concurrent REPLICATE streams. It does not
+	// bound the number of streams opened on any one of those connections.
 	ReplicateClientIdlePoolSize = 6
+
+	// commitDeadlineSlack is reserved ahead of a CommitCtx deadline to
+	// guarantee the terminating chunk and trailer are written and
+	// flushed before the deadline elapses, rather than racing it.
+	commitDeadlineSlack = 250 * time.Millisecond
 )
 
+// ReplicateClientMaxIdleDuration bounds how long an HTTP/1.1 connection
+// may sit unused in an idle pool before the pool's reaper closes it,
+// regardless of whether it still probes as live. It's a var rather than
+// a const so tests and long-running processes can tune it.
+var ReplicateClientMaxIdleDuration = 5 * time.Minute
+
 type ReplicateClient struct {
 	endpoint *discovery.Endpoint
-	idlePool chan replicaClientConn
+	idlePool *connPool
+	useHTTP2 bool
 }
 
 type replicaClientConn struct {
 	raw net.Conn
 	buf *bufio.ReadWriter
+
+	// idleSince is set by putConn and consulted by the pool's reaper to
+	// evict connections that have sat unused for too long.
+	idleSince time.Time
 }
 
 type replicaClientTransaction struct {
@@ -46,15 +74,56 @@ type replicaClientTransaction struct {
 	chunker io.WriteCloser
 	conn    replicaClientConn
 	request *http.Request
+
+	// h2 is non-nil when the transaction is multiplexed over HTTP/2
+	// (see replicate_client_http2.go), in which case the HTTP/1.1 fields
+	// above are unused.
+	h2 *h2Transaction
+
+	// aborting is set by CommitCtx once it has decided to abandon the
+	// commit ahead of its deadline, so a racing Write is rejected rather
+	// than corrupting the frame we're about to terminate.
+	aborting int32
+
+	// journal and started back the lifecycle events published to
+	// ReplicateEvents; see replicate_events.go.
+	journal journal.Name
+	started time.Time
 }
 
+// ReplicateTimeoutError is returned by CommitCtx when the caller's
+// context deadline is reached before the commit finishes, mirroring the
+// distinction go-ethereum's RPC HTTP stack draws between a write that
+// never made it onto the wire and one that did, leaving only the peer's
+// response outstanding.
+type ReplicateTimeoutError struct {
+	// Flushed is true if the terminating chunk and commit-delta trailer
+	// (real or a synthesized abort) were written and flushed to the peer
+	// before the deadline elapsed. The peer can safely recycle its
+	// connection in this case; if false, the connection was left in an
+	// indeterminate state and was closed.
+	Flushed bool
+}
+
+func (e *ReplicateTimeoutError) Error() string {
+	if e.Flushed {
+		return "gazette: replicate commit deadline exceeded waiting on peer response"
+	}
+	return "gazette: replicate commit deadline exceeded before commit could be flushed"
+}
+
+// NewReplicateClient returns a ReplicateClient that speaks the original
+// HTTP/1.1 chunked REPLICATE protocol, claiming an exclusive pooled TCP
+// connection per transaction. Use NewReplicateClientHTTP2 for peers that
+// support multiplexing many transactions over a handful of connections.
 func NewReplicateClient(ep *discovery.Endpoint) ReplicateClient {
 	// Use a global map of pools keyed on BaseURL to facilitate connection re-use.
 	idlePoolsMu.Lock()
 	idlePool, ok := idlePools[ep.BaseURL]
 	if !ok {
-		idlePool = make(chan replicaClientConn, ReplicateClientIdlePoolSize)
+		idlePool = newConnPool()
 		idlePools[ep.BaseURL] = idlePool
+		go idlePool.reap(ReplicateClientMaxIdleDuration)
 	}
 	idlePoolsMu.Unlock()
 
@@ -64,17 +133,55 @@ func NewReplicateClient(ep *discovery.Endpoint) ReplicateClient {
 	}
 }
 
+// NewReplicateClientHTTP2 returns a ReplicateClient that dials peers over
+// HTTP/2 (ALPN "h2" over TLS, or h2c prior-knowledge cleartext for
+// intra-cluster use) and streams REPLICATE requests as multiplexed HTTP/2
+// streams rather than claiming a TCP connection per transaction. The
+// commit delta is carried as an X-Commit-Delta trailer instead of a
+// trailing chunked header.
+func NewReplicateClientHTTP2(ep *discovery.Endpoint) ReplicateClient {
+	return ReplicateClient{
+		endpoint: ep,
+		useHTTP2: true,
+	}
+}
+
+// PoolStats returns a snapshot of the idle connection pool's counters.
+// It's a no-op (zero value) under NewReplicateClientHTTP2, which doesn't
+// use the HTTP/1.1 idle pool.
+func (c ReplicateClient) PoolStats() ConnPoolStats {
+	if c.idlePool == nil {
+		return ConnPoolStats{}
+	}
+	return c.idlePool.stats()
+}
+
 func (c ReplicateClient) Replicate(op journal.ReplicateOp) {
 	transaction := replicaClientTransaction{client: c}
 	go transaction.start(op)
 }
 
 func (t *replicaClientTransaction) start(op journal.ReplicateOp) {
-	conn, err := t.takeConn()
+	t.journal = op.Journal
+	t.started = time.Now()
+
+	if t.client.useHTTP2 {
+		t.startHTTP2(op)
+		return
+	}
+	t.startHTTP1(op)
+}
+
+func (t *replicaClientTransaction) startHTTP1(op journal.ReplicateOp) {
+	conn, dialed, err := t.takeConn()
 	if err != nil {
+		t.publishFailed(err, 0)
 		op.Result <- journal.ReplicateResult{Error: err}
 		return
 	}
+	if dialed {
+		ReplicateEvents.Publish(DialedEvent{eventJournal(t.journal)})
+	}
 	req, _ := t.client.endpoint.NewHTTPRequest("REPLICATE", "/"+op.Journal.String(), nil)
 	queryArgs := url.Values{
 		"newSpool":   {strconv.FormatBool(op.NewSpool)},
@@ -87,20 +194,27 @@ func (t *replicaClientTransaction) start(op journal.ReplicateOp) {
 
 	reqBytes, err := httputil.DumpRequest(req, false)
 	if err != nil {
+		t.publishFailed(err, 0)
 		op.Result <- journal.ReplicateResult{Error: err}
 		return
 	}
 	// Flush the replication request to the peer.
 	conn.buf.Write(reqBytes)
 	if err = conn.buf.Flush(); err != nil {
+		t.publishFailed(err, 0)
 		op.Result <- journal.ReplicateResult{Error: err}
 		return
 	}
-	// Wait up to a minute for a 100-continue response.
-	// TODO(johnny): HTTP/2 to peers would remove the need for this timeout.
+	ReplicateEvents.Publish(SentHeadersEvent{eventJournal(t.journal)})
+
+	// Wait up to a minute for a 100-continue response. This timeout is
+	// specific to the HTTP/1.1 path: peers dialed via
+	// NewReplicateClientHTTP2 multiplex over long-lived connections and
+	// don't block a whole socket on a single slow peer.
 	conn.raw.SetReadDeadline(time.Now().Add(time.Minute))
 	resp, err := http.ReadResponse(conn.buf.Reader, req)
 	if err != nil {
+		t.publishFailed(err, 0)
 		op.Result <- journal.ReplicateResult{Error: err}
 		return
 	} else if resp.StatusCode != http.StatusContinue {
@@ -121,10 +235,13 @@ func (t *replicaClientTransaction) start(op journal.ReplicateOp) {
 			// Connection is still okay. Retain for the next round.
 			t.putConn(conn)
 		}
+		t.publishFailed(errors.New(body.String()), remoteWriteHead)
 		op.Result <- journal.ReplicateResult{Error: errors.New(body.String()),
 			ErrorWriteHead: remoteWriteHead}
 		return
 	}
+	ReplicateEvents.Publish(GotContinueEvent{eventJournal(t.journal)})
+
 	// We've now opened a transaction stream.
 	conn.raw.SetReadDeadline(time.Time{}) // Clear timeout.
 	t.chunker = httputil.NewChunkedWriter(conn.buf)
@@ -135,52 +252,146 @@ func (t *replicaClientTransaction) start(op journal.ReplicateOp) {
 	return
 }
 
-func (t *replicaClientTransaction) takeConn() (replicaClientConn, error) {
-	var conn replicaClientConn
-	select {
-	case conn = <-t.client.idlePool:
-		return conn, nil
-	default:
+// publishFailed publishes a FailedEvent for this transaction's journal.
+func (t *replicaClientTransaction) publishFailed(err error, writeHead int64) {
+	ReplicateEvents.Publish(FailedEvent{eventJournal(t.journal), err, writeHead})
+}
+
+// takeConn returns a connection from the idle pool, or dials a fresh one
+// if the pool is empty or every pooled connection fails its liveness
+// check. The returned bool is true iff a fresh connection was dialed.
+func (t *replicaClientTransaction) takeConn() (replicaClientConn, bool, error) {
+	for {
+		conn, ok := t.client.idlePool.take()
+		if !ok {
+			break
+		}
+		// The peer may have half-closed the connection, dropped it via a
+		// NAT/idle timeout, or crashed and restarted while it sat idle in
+		// the pool. Catch that here rather than mid-transaction.
+		if !t.client.idlePool.checkLive(conn) {
+			continue
+		}
+		t.client.idlePool.onReused()
+		return conn, false, nil
 	}
 
 	url, err := t.client.endpoint.ResolveURL()
 	if err != nil {
-		return replicaClientConn{}, err
+		return replicaClientConn{}, false, err
 	}
 	raw, err := net.Dial("tcp", url.Host)
 	if err != nil {
 		t.client.endpoint.InvalidateResolution()
-		return replicaClientConn{}, err
+		return replicaClientConn{}, false, err
 	}
-	return replicaClientConn{raw,
-		bufio.NewReadWriter(bufio.NewReader(raw), bufio.NewWriter(raw))}, nil
+	t.client.idlePool.onOpened()
+	return replicaClientConn{raw: raw,
+		buf: bufio.NewReadWriter(bufio.NewReader(raw), bufio.NewWriter(raw))}, true, nil
 }
 
 func (t *replicaClientTransaction) putConn(conn replicaClientConn) {
 	conn.raw.SetReadDeadline(time.Time{}) // Clear timeout.
-	select {
-	case t.client.idlePool <- conn:
-	default:
-	}
+	conn.idleSince = time.Now()
+	t.client.idlePool.put(conn)
 }
 
 func (t *replicaClientTransaction) Write(p []byte) (n int, err error) {
-	return t.chunker.Write(p)
+	if t.h2 != nil {
+		n, err = t.h2.write(p)
+	} else if atomic.LoadInt32(&t.aborting) != 0 {
+		return 0, errors.New("gazette: write after replicate commit deadline")
+	} else {
+		n, err = t.chunker.Write(p)
+	}
+	if n > 0 {
+		ReplicateEvents.Publish(WroteBytesEvent{eventJournal(t.journal), n})
+	}
+	return n, err
 }
 
+// Commit is equivalent to CommitCtx with a context carrying the same
+// flat one-minute deadline the client has always used.
 func (t *replicaClientTransaction) Commit(delta int64) error {
-	// Close the chunker and write the commit delta as a trailing header.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return t.CommitCtx(ctx, delta)
+}
+
+// CommitCtx commits the transaction with |delta|, honoring |ctx|'s
+// deadline. As the deadline approaches, CommitCtx reserves
+// commitDeadlineSlack to guarantee the terminating chunk and a trailer
+// land on the wire before the deadline elapses -- a synthesized
+// AbortReasonHeader trailer with a zero CommitDeltaHeader if there's no
+// time left for the real one -- so the peer sees a clean abort and can
+// recycle its connection instead of observing a truncated body.
+func (t *replicaClientTransaction) CommitCtx(ctx context.Context, delta int64) error {
+	if t.h2 != nil {
+		err := t.h2.commitCtx(ctx, delta)
+		t.publishCommit(delta, err)
+		return err
+	}
+
+	// abortThreshold is commitDeadlineSlack short of the real deadline: we
+	// decide to abort once there's no longer enough runway to safely write
+	// and flush a normal commit. The write deadline actually handed to the
+	// socket below is the real ctx.Deadline(), not abortThreshold, so that
+	// reserved slack is available to the abort Flush itself -- otherwise
+	// the terminator write would race a deadline that's already elapsed.
+	deadline, haveDeadline := ctx.Deadline()
+	abortThreshold := deadline.Add(-commitDeadlineSlack)
+	aborting := haveDeadline && !time.Now().Before(abortThreshold)
+	if aborting {
+		atomic.StoreInt32(&t.aborting, 1)
+	}
+
+	writeDeadline := time.Time{}
+	if haveDeadline {
+		writeDeadline = deadline
+	}
+	t.conn.raw.SetWriteDeadline(writeDeadline)
 	t.chunker.Close()
-	fmt.Fprintf(t.conn.buf, "%s: %x\r\n\r\n", CommitDeltaHeader, delta)
+	if aborting {
+		fmt.Fprintf(t.conn.buf, "%s: 0\r\n%s: deadline\r\n\r\n", CommitDeltaHeader, AbortReasonHeader)
+	} else {
+		fmt.Fprintf(t.conn.buf, "%s: %x\r\n\r\n", CommitDeltaHeader, delta)
+	}
 
 	if err := t.conn.buf.Flush(); err != nil {
-		return err
+		t.conn.raw.Close()
+		timeoutErr := &ReplicateTimeoutError{Flushed: false}
+		t.publishCommit(delta, timeoutErr)
+		return timeoutErr
+	}
+	t.conn.raw.SetWriteDeadline(time.Time{})
+
+	if aborting {
+		// We never read the peer's response to this abort, so there's no
+		// way to know whether it considers the connection cleanly
+		// recyclable; closing it (rather than pooling it) is the only safe
+		// choice, same as every other error return in CommitCtx.
+		t.conn.raw.Close()
+		timeoutErr := &ReplicateTimeoutError{Flushed: true}
+		t.publishCommit(delta, timeoutErr)
+		return timeoutErr
+	}
+
+	// Wait for the commit response, but no later than either the caller's
+	// deadline or the long-standing one-minute ceiling, whichever is sooner.
+	readDeadline := time.Now().Add(time.Minute)
+	if haveDeadline && deadline.Before(readDeadline) {
+		readDeadline = deadline
 	}
-	// Wait up to a minute for a commit response.
-	// TODO(johnny): HTTP/2 to peers would remove the need for this timeout.
-	t.conn.raw.SetReadDeadline(time.Now().Add(time.Minute))
+	t.conn.raw.SetReadDeadline(readDeadline)
 	resp, err := http.ReadResponse(t.conn.buf.Reader, t.request)
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.conn.raw.Close()
+			timeoutErr := &ReplicateTimeoutError{Flushed: true}
+			t.publishCommit(delta, timeoutErr)
+			return timeoutErr
+		}
+		t.publishCommit(delta, err)
 		return err
 	}
 	// Success is indicated by 204 No Content.
@@ -194,15 +405,26 @@ func (t *replicaClientTransaction) Commit(delta int64) error {
 	if !resp.Close {
 		t.putConn(t.conn)
 	}
+	t.publishCommit(delta, err)
 	return err
 }
 
+// publishCommit publishes a CommittedEvent on success, or a FailedEvent
+// otherwise, timed from the transaction's start() call.
+func (t *replicaClientTransaction) publishCommit(delta int64, err error) {
+	if err != nil {
+		t.publishFailed(err, 0)
+		return
+	}
+	ReplicateEvents.Publish(CommittedEvent{eventJournal(t.journal), delta, time.Since(t.started)})
+}
+
 var (
 	// Pool idle connections keyed on BaseURL of an endpoint.
-	idlePools   map[string]chan replicaClientConn
+	idlePools   map[string]*connPool
 	idlePoolsMu sync.Mutex
 )
 
 func init() {
-	idlePools = make(map[string]chan replicaClientConn)
+	idlePools = make(map[string]*connPool)
 }
@@ -0,0 +1,345 @@
+package gazette
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/http2"
+
+	"github.com/pippio/gazette/journal"
+)
+
+// h2Pool multiplexes many concurrent REPLICATE / Commit streams over a
+// small number of HTTP/2 connections to a single peer. Unlike the
+// HTTP/1.1 |idlePool|, connections are never exclusively checked out:
+// ReplicateClientIdlePoolSize instead bounds how many *http2.ClientConns
+// are kept per peer. The number of streams pushed onto one connection is
+// not bounded here; a new connection is dialed (below the cap) only once
+// every pooled one reports it can't take a new request.
+type h2Pool struct {
+	transport *http2.Transport
+	dial      func() (net.Conn, error)
+
+	mu    sync.Mutex
+	conns []*http2.ClientConn
+}
+
+var (
+	// h2Pools is keyed on BaseURL, mirroring |idlePools|.
+	h2Pools   map[string]*h2Pool
+	h2PoolsMu sync.Mutex
+)
+
+func init() {
+	h2Pools = make(map[string]*h2Pool)
+}
+
+// h2PoolFor returns (creating if needed) the h2Pool for |baseURL|. |dial|
+// establishes a fresh TCP (or TLS) connection to the peer on demand; it's
+// invoked with h2PoolsMu unlocked.
+func h2PoolFor(baseURL string, dial func() (net.Conn, error)) *h2Pool {
+	h2PoolsMu.Lock()
+	defer h2PoolsMu.Unlock()
+
+	p, ok := h2Pools[baseURL]
+	if !ok {
+		p = &h2Pool{
+			transport: &http2.Transport{
+				// Permit cleartext h2c for intra-cluster peers that don't
+				// terminate TLS; peers reached over TLS negotiate "h2" via
+				// ALPN as usual and this flag is ignored.
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return dial()
+				},
+			},
+			dial: dial,
+		}
+		h2Pools[baseURL] = p
+	}
+	return p
+}
+
+// take returns a *http2.ClientConn able to accept another request,
+// dialing a new connection if every pooled connection is saturated (or
+// none exist yet). ReplicateClientIdlePoolSize caps how many of these
+// pooled connections we keep around concurrently; once at the cap we
+// reuse the least-recently-dialed one regardless of its reported
+// concurrency.
+func (p *h2Pool) take() (*http2.ClientConn, error) {
+	p.mu.Lock()
+	var available *http2.ClientConn
+	for i := 0; i < len(p.conns); {
+		cc := p.conns[i]
+		if state := cc.State(); state.Closed || state.Closing {
+			// The connection is actually dead (not merely saturated with
+			// in-flight streams): drop it from the pool and close it, so
+			// we don't leak the TCP connection or its http2 read loop.
+			cc.Close()
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			continue
+		}
+		i++
+		if available == nil && cc.CanTakeNewRequest() {
+			available = cc
+		}
+	}
+	if available != nil {
+		p.mu.Unlock()
+		return available, nil
+	}
+	if len(p.conns) > 0 && len(p.conns) >= ReplicateClientIdlePoolSize {
+		// Every live connection is saturated and we're at the pool cap;
+		// reuse the least-recently-dialed one rather than growing without
+		// bound. It stays in the pool (not dropped/closed) since it's
+		// still healthy and will free up as its streams complete.
+		cc := p.conns[0]
+		p.mu.Unlock()
+		return cc, nil
+	}
+	p.mu.Unlock()
+
+	raw, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.transport.NewClientConn(raw)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	p.mu.Lock()
+	p.conns = append(p.conns, cc)
+	p.mu.Unlock()
+	return cc, nil
+}
+
+// trailerBody is an io.ReadCloser wrapping an *io.PipeReader. net/http
+// only sends a request's Trailer values once the body's final Read has
+// returned EOF, so commitCtx sets the trailer before closing the pipe
+// writer, guaranteeing the commit delta is on the wire by the time this
+// reaches EOF.
+type trailerBody struct {
+	pr *io.PipeReader
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) { return b.pr.Read(p) }
+
+func (b *trailerBody) Close() error { return b.pr.Close() }
+
+// h2RoundTrip is the result of an in-flight http2.ClientConn.RoundTrip,
+// delivered asynchronously since the request body (and thus the commit
+// delta trailer) is only finalized once the caller invokes Commit.
+type h2RoundTrip struct {
+	resp *http.Response
+	err  error
+}
+
+// startHTTP2 is the HTTP/2 analogue of startHTTP1: it opens a REPLICATE
+// stream multiplexed over a pooled *http2.ClientConn instead of claiming
+// an entire TCP connection, and emits the commit delta as an
+// X-Commit-Delta trailer rather than a trailing chunked header.
+func (t *replicaClientTransaction) startHTTP2(op journal.ReplicateOp) {
+	url, err := t.client.endpoint.ResolveURL()
+	if err != nil {
+		t.publishFailed(err, 0)
+		op.Result <- journal.ReplicateResult{Error: err}
+		return
+	}
+	// Peers reached over "https" negotiate HTTP/2 via ALPN; intra-cluster
+	// peers reached over plain "http" speak h2c prior-knowledge cleartext,
+	// so no TLS handshake is performed against them.
+	dial := func() (net.Conn, error) {
+		if url.Scheme == "https" {
+			return tls.Dial("tcp", url.Host, &tls.Config{NextProtos: []string{"h2"}})
+		}
+		return net.Dial("tcp", url.Host)
+	}
+	pool := h2PoolFor(t.client.endpoint.BaseURL, dial)
+
+	// newRequest builds a fresh REPLICATE request for this op; h2Transaction
+	// calls it again if it needs to re-dial and retry the stream.
+	newRequest := func() *http.Request {
+		req, _ := t.client.endpoint.NewHTTPRequest("REPLICATE", "/"+op.Journal.String(), nil)
+		queryArgs := req.URL.Query()
+		queryArgs.Set("newSpool", strconv.FormatBool(op.NewSpool))
+		queryArgs.Set("writeHead", strconv.FormatInt(op.WriteHead, 10))
+		queryArgs.Set("routeToken", op.RouteToken)
+		req.URL.RawQuery = queryArgs.Encode()
+
+		// Declare the trailer key up front; its value is filled in by
+		// commitCtx once Commit has written the final byte.
+		req.Trailer = http.Header{CommitDeltaHeader: nil}
+		req.ContentLength = -1
+		return req
+	}
+
+	h2 := &h2Transaction{pool: pool, newRequest: newRequest}
+	if err := h2.dial(); err != nil {
+		t.client.endpoint.InvalidateResolution()
+		t.publishFailed(err, 0)
+		op.Result <- journal.ReplicateResult{Error: err}
+		return
+	}
+	// h2Pool.take doesn't distinguish a freshly dialed ClientConn from a
+	// reused one, so every stream reports Dialed; unlike the HTTP/1.1
+	// pool, a "dial" here is cheap relative to opening a whole new
+	// REPLICATE transaction.
+	ReplicateEvents.Publish(DialedEvent{eventJournal(t.journal)})
+
+	t.h2 = h2
+	op.Result <- journal.ReplicateResult{Writer: t}
+}
+
+// h2Transaction holds the state of an in-flight HTTP/2-transported
+// replication stream, as opposed to the HTTP/1.1 chunked fields on
+// replicaClientTransaction. Its fields are guarded by mu because dial can
+// replace them out from under an in-flight write/commitCtx call if the
+// stream it opened turns out to have lost a race with a GOAWAY.
+type h2Transaction struct {
+	pool       *h2Pool
+	newRequest func() *http.Request
+
+	mu         sync.Mutex
+	clientConn *http2.ClientConn
+	pipeWriter *io.PipeWriter
+	request    *http.Request
+	result     chan h2RoundTrip
+
+	// cancelCtx cancels only this stream's request context, signaling
+	// cc.RoundTrip to RST_STREAM without touching the shared ClientConn.
+	cancelCtx context.CancelFunc
+
+	// wrote is set by write once a body write has completed successfully,
+	// after which a RoundTrip failure is a genuine mid-transfer failure
+	// rather than a stream that never got off the ground -- only the
+	// latter is safe to silently retry.
+	wrote bool
+}
+
+// dial takes a connection from the pool and opens a new REPLICATE stream
+// on it, replacing this h2Transaction's in-flight stream state. It's
+// called once by startHTTP2, and again by write if the stream it opened
+// turns out to have lost a race against a GOAWAY or reset before any
+// body bytes made it to the peer.
+func (h *h2Transaction) dial() error {
+	cc, err := h.pool.take()
+	if err != nil {
+		return err
+	}
+	req := h.newRequest()
+	pr, pw := io.Pipe()
+	req.Body = &trailerBody{pr: pr}
+
+	// streamCtx scopes cancellation to this single stream: canceling it on
+	// a commit deadline resets only our RST_STREAM, leaving the shared
+	// *http2.ClientConn (and every other journal's in-flight stream on it)
+	// untouched.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(streamCtx)
+
+	rtCh := make(chan h2RoundTrip, 1)
+	go func() {
+		resp, err := cc.RoundTrip(req)
+		rtCh <- h2RoundTrip{resp, err}
+	}()
+
+	result := make(chan h2RoundTrip, 1)
+	h.mu.Lock()
+	h.clientConn = cc
+	h.pipeWriter = pw
+	h.request = req
+	h.cancelCtx = cancel
+	h.result = result
+	h.mu.Unlock()
+
+	go h.watch(rtCh, pw, result)
+	return nil
+}
+
+// watch waits for cc.RoundTrip to return and forwards the result to
+// commitCtx via |result|, the channel dial created for this same stream,
+// so a stream abandoned by a retry never delivers its result to the
+// stream that replaced it. If RoundTrip failed, nothing will ever read
+// from the pipe again, so it also releases a write that's blocked on (or
+// about to start on) it -- otherwise a RoundTrip failure that lands before
+// the peer has read any of the body would hang the next write forever.
+func (h *h2Transaction) watch(rtCh chan h2RoundTrip, pw *io.PipeWriter, result chan h2RoundTrip) {
+	rt := <-rtCh
+	if rt.err != nil {
+		pw.CloseWithError(rt.err)
+	}
+	result <- rt
+}
+
+// write hands |p| to the current stream's pipe. If the stream never got
+// off the ground -- the signature of losing a race against a GOAWAY or
+// reset on an otherwise-healthy pooled connection, rather than a genuine
+// mid-transfer failure -- it transparently re-dials a fresh stream and
+// retries, rather than surfacing a failure the caller has no way to
+// distinguish from a real one.
+func (h *h2Transaction) write(p []byte) (int, error) {
+	for {
+		h.mu.Lock()
+		pw, wrote := h.pipeWriter, h.wrote
+		h.mu.Unlock()
+
+		n, err := pw.Write(p)
+		if err == nil {
+			h.mu.Lock()
+			h.wrote = true
+			h.mu.Unlock()
+			return n, nil
+		}
+		if wrote {
+			return n, err
+		}
+		if dialErr := h.dial(); dialErr != nil {
+			return n, err
+		}
+	}
+}
+
+// commitCtx mirrors replicaClientTransaction.CommitCtx for the HTTP/2
+// path. HTTP/2 streams don't suffer the truncated-chunked-body ambiguity
+// the HTTP/1.1 path guards against (a RST_STREAM unambiguously tells the
+// peer the stream was abandoned), so there's no terminating-frame slack
+// window to reserve here -- CommitCtx just needs to stop waiting on the
+// peer once |ctx| is done and report a *ReplicateTimeoutError. Canceling
+// cancelCtx resets only this stream; the shared *http2.ClientConn, and
+// every other journal's transaction multiplexed over it, is untouched.
+func (h *h2Transaction) commitCtx(ctx context.Context, delta int64) error {
+	h.mu.Lock()
+	req, pw, result, cancel := h.request, h.pipeWriter, h.result, h.cancelCtx
+	h.mu.Unlock()
+
+	req.Trailer.Set(CommitDeltaHeader, strconv.FormatInt(delta, 16))
+	pw.Close()
+
+	select {
+	case rt := <-result:
+		if rt.err != nil {
+			return rt.err
+		}
+		defer rt.resp.Body.Close()
+
+		if rt.resp.StatusCode != http.StatusNoContent {
+			var body bytes.Buffer
+			io.Copy(&body, rt.resp.Body)
+			return errors.New(body.String())
+		}
+		io.Copy(ioutil.Discard, rt.resp.Body)
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return &ReplicateTimeoutError{Flushed: true}
+	}
+}
@@ -0,0 +1,189 @@
+package gazette
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// TestH2PoolConcurrentReplicateAndCommit drives many concurrent REPLICATE
+// streams -- each writing a chunked body and committing via an
+// X-Commit-Delta trailer -- over pooled *http2.ClientConns (several may
+// be dialed when streams race to take from an empty pool) against an
+// in-process h2c server, exercising the multiplexing this
+// package's h2Pool and trailerBody exist to provide.
+//
+// This exercises the h2 transport layer directly rather than going
+// through ReplicateClient.Replicate/Commit: those additionally require a
+// *discovery.Endpoint, whose package isn't part of this checkout.
+func TestH2PoolConcurrentReplicateAndCommit(t *testing.T) {
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "REPLICATE" {
+			http.Error(w, "expected REPLICATE", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(body) == 0 {
+			http.Error(w, "expected a non-empty body", http.StatusBadRequest)
+			return
+		}
+		if got := r.Trailer.Get(CommitDeltaHeader); got == "" {
+			http.Error(w, "missing commit delta trailer", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	pool := h2PoolFor(srv.URL, func() (net.Conn, error) {
+		return net.Dial("tcp", srv.Listener.Addr().String())
+	})
+
+	const concurrency = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			cc, err := pool.take()
+			if err != nil {
+				errs <- fmt.Errorf("stream %d: take: %v", i, err)
+				return
+			}
+
+			pr, pw := io.Pipe()
+			req, _ := http.NewRequest("REPLICATE", srv.URL+"/a/journal", &trailerBody{pr: pr})
+			req.Trailer = http.Header{CommitDeltaHeader: nil}
+			req.ContentLength = -1
+
+			rtCh := make(chan h2RoundTrip, 1)
+			go func() {
+				resp, err := cc.RoundTrip(req)
+				rtCh <- h2RoundTrip{resp, err}
+			}()
+
+			// Write the spool body, then commit by setting the trailer
+			// value before closing the pipe -- mirroring h2Transaction's
+			// write/commitCtx split.
+			fmt.Fprintf(pw, "payload-%d", i)
+			req.Trailer.Set(CommitDeltaHeader, strconv.FormatInt(int64(i), 16))
+			pw.Close()
+
+			rt := <-rtCh
+			if rt.err != nil {
+				errs <- fmt.Errorf("stream %d: RoundTrip: %v", i, rt.err)
+				return
+			}
+			defer rt.resp.Body.Close()
+			if rt.resp.StatusCode != http.StatusNoContent {
+				errs <- fmt.Errorf("stream %d: unexpected status %s", i, rt.resp.Status)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestH2TransactionRetriesLostRace guards against a regression where a
+// stream that lost a race against a GOAWAY or reset -- its RoundTrip
+// failing before the peer read any of the body -- left write hanging
+// forever on a pipe nobody would ever read from again. h2Transaction.write
+// is expected to notice, re-dial a fresh stream, and retry transparently.
+func TestH2TransactionRetriesLostRace(t *testing.T) {
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || string(body) != "payload" {
+			http.Error(w, "unexpected body", http.StatusBadRequest)
+			return
+		}
+		if got := r.Trailer.Get(CommitDeltaHeader); got == "" {
+			http.Error(w, "missing commit delta trailer", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	// deadLn accepts a connection and immediately closes it, simulating a
+	// pooled connection that loses a race against a GOAWAY or reset
+	// between h2Pool.take and the stream it hands out actually opening.
+	deadLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadLn.Close()
+	go func() {
+		for {
+			c, err := deadLn.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	var dials int32
+	pool := &h2Pool{
+		transport: &http2.Transport{AllowHTTP: true, DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}},
+		dial: func() (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) == 1 {
+				return net.Dial("tcp", deadLn.Addr().String())
+			}
+			return net.Dial("tcp", srv.Listener.Addr().String())
+		},
+	}
+
+	h2 := &h2Transaction{pool: pool, newRequest: func() *http.Request {
+		req, _ := http.NewRequest("REPLICATE", srv.URL+"/a/journal", nil)
+		req.Trailer = http.Header{CommitDeltaHeader: nil}
+		req.ContentLength = -1
+		return req
+	}}
+	if err := h2.dial(); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := h2.write([]byte("payload"))
+		writeDone <- err
+	}()
+
+	select {
+	case err := <-writeDone:
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write hung after the first stream lost its race against the dead connection")
+	}
+
+	if err := h2.commitCtx(context.Background(), 1); err != nil {
+		t.Fatalf("commitCtx: %v", err)
+	}
+	if got := atomic.LoadInt32(&dials); got < 2 {
+		t.Fatalf("expected a retry dial, got %d total dials", got)
+	}
+}
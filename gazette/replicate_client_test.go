@@ -0,0 +1,72 @@
+package gazette
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http/httputil"
+	"testing"
+	"time"
+)
+
+// TestCommitCtxAbortClosesConnection guards against a regression where a
+// deadline-triggered abort that still managed to flush its synthesized
+// AbortReasonHeader trailer left the underlying connection neither closed
+// nor returned to the idle pool, leaking it. Since CommitCtx never reads
+// the peer's response to an abort, the peer's framing state is unknown
+// and the connection must be closed rather than pooled.
+func TestCommitCtxAbortClosesConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverClosed := make(chan struct{})
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Read until the peer closes its half, confirming CommitCtx closed
+		// the connection rather than leaving it open and pooled.
+		buf := make([]byte, 4096)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				close(serverClosed)
+				return
+			}
+		}
+	}()
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := replicaClientConn{raw: raw, buf: bufio.NewReadWriter(bufio.NewReader(raw), bufio.NewWriter(raw))}
+
+	txn := &replicaClientTransaction{
+		chunker: httputil.NewChunkedWriter(conn.buf),
+		conn:    conn,
+		journal: "a/journal",
+		started: time.Now(),
+	}
+
+	// A deadline already inside commitDeadlineSlack forces CommitCtx onto
+	// the abort path without needing to race a timer, while leaving the
+	// slack for the synthesized trailer to be flushed.
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(commitDeadlineSlack/2))
+	defer cancel()
+
+	err = txn.CommitCtx(ctx, 0)
+	if te, ok := err.(*ReplicateTimeoutError); !ok || !te.Flushed {
+		t.Fatalf("expected a flushed *ReplicateTimeoutError, got %v", err)
+	}
+
+	select {
+	case <-serverClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed after an aborted commit")
+	}
+}
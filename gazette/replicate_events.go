@@ -0,0 +1,182 @@
+package gazette
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pippio/gazette/journal"
+)
+
+// Event is published by a replicaClientTransaction at each stage of a
+// REPLICATE request. Each stage has its own concrete type (DialedEvent,
+// CommittedEvent, etc); use a type switch, or the FilterByEventKind /
+// FilterByJournal helpers, to select the stages a subscriber cares about.
+type Event interface {
+	// EventJournal is the journal the transaction is replicating.
+	EventJournal() journal.Name
+	// EventKind names the concrete event type, e.g. "Committed".
+	EventKind() string
+}
+
+type eventJournal journal.Name
+
+func (j eventJournal) EventJournal() journal.Name { return journal.Name(j) }
+
+// DialedEvent fires when an HTTP/1.1 transaction dials a fresh connection
+// to the peer, as opposed to reusing one from the idle pool. Under
+// NewReplicateClientHTTP2 it fires for every transaction, whether or not
+// a new connection was dialed.
+type DialedEvent struct{ eventJournal }
+
+func (DialedEvent) EventKind() string { return "Dialed" }
+
+// SentHeadersEvent fires once the REPLICATE request line and headers
+// have been flushed to the peer.
+type SentHeadersEvent struct{ eventJournal }
+
+func (SentHeadersEvent) EventKind() string { return "SentHeaders" }
+
+// GotContinueEvent fires once the peer's 100-continue response has been
+// read and the transaction is clear to start streaming the spool.
+type GotContinueEvent struct{ eventJournal }
+
+func (GotContinueEvent) EventKind() string { return "GotContinue" }
+
+// WroteBytesEvent fires after each Write to the transaction, reporting
+// the number of spool bytes just written.
+type WroteBytesEvent struct {
+	eventJournal
+	N int
+}
+
+func (WroteBytesEvent) EventKind() string { return "WroteBytes" }
+
+// CommittedEvent fires once a transaction's Commit has succeeded.
+type CommittedEvent struct {
+	eventJournal
+	Delta    int64
+	Duration time.Duration
+}
+
+func (CommittedEvent) EventKind() string { return "Committed" }
+
+// FailedEvent fires any time a transaction ends in an error, whether
+// during dial, header exchange, or Commit. WriteHead is the write head
+// reported by a peer that rejects the REPLICATE request before sending
+// 100-continue; it is 0 for every other failure, including Commit's.
+type FailedEvent struct {
+	eventJournal
+	Err       error
+	WriteHead int64
+}
+
+func (FailedEvent) EventKind() string { return "Failed" }
+
+// FilterByJournal returns a Subscribe filter that admits only events for
+// |name|.
+func FilterByJournal(name journal.Name) func(Event) bool {
+	return func(e Event) bool { return e.EventJournal() == name }
+}
+
+// FilterByEventKind returns a Subscribe filter that admits only events
+// whose EventKind() is one of |kinds| (e.g. "Committed", "Failed").
+func FilterByEventKind(kinds ...string) func(Event) bool {
+	set := make(map[string]struct{}, len(kinds))
+	for _, k := range kinds {
+		set[k] = struct{}{}
+	}
+	return func(e Event) bool {
+		_, ok := set[e.EventKind()]
+		return ok
+	}
+}
+
+// eventSubscriber holds one Subscribe registration. Publish never blocks
+// on it: if |ch| is full, the event is dropped and |dropped| incremented
+// rather than the replication hot path stalling on a slow reader.
+type eventSubscriber struct {
+	filter  func(Event) bool
+	ch      chan<- Event
+	dropped int64
+}
+
+// EventSubscription is returned by Subscribe and lets the caller monitor
+// how many events its subscription has dropped, e.g. to surface it
+// alongside a /debug/replication/trace stream.
+type EventSubscription struct {
+	sub *eventSubscriber
+}
+
+// Dropped returns the number of events dropped so far because this
+// subscription's channel was full when Publish tried to send to it.
+func (s *EventSubscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.sub.dropped)
+}
+
+// ReplicateEventBus fans replication lifecycle events out to subscribers
+// such as a /debug/replication/trace endpoint, without ever risking a
+// stall in the Commit path: Publish is non-blocking and drops events on
+// subscribers that can't keep up.
+type ReplicateEventBus struct {
+	mu   sync.Mutex
+	subs map[*eventSubscriber]struct{}
+}
+
+// NewReplicateEventBus returns an empty, ready-to-use event bus.
+func NewReplicateEventBus() *ReplicateEventBus {
+	return &ReplicateEventBus{subs: make(map[*eventSubscriber]struct{})}
+}
+
+// Subscribe registers |ch| to receive events matching |filter| (or every
+// event, if |filter| is nil) until |done| is closed. |ch| should be
+// large and buffered (e.g. 100,000 deep) since Publish never blocks on
+// it: a full channel simply drops the event and counts it as dropped,
+// visible via the returned *EventSubscription's Dropped method.
+// Subscribe is safe to call concurrently with in-flight transactions
+// that are publishing to the bus.
+func (b *ReplicateEventBus) Subscribe(filter func(Event) bool, ch chan<- Event, done <-chan struct{}) *EventSubscription {
+	sub := &eventSubscriber{filter: filter, ch: ch}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-done
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}()
+
+	return &EventSubscription{sub: sub}
+}
+
+// Publish delivers |e| to every current subscriber whose filter admits
+// it. It never blocks: a subscriber whose channel is full has the event
+// dropped and its drop counter incremented instead.
+func (b *ReplicateEventBus) Publish(e Event) {
+	b.mu.Lock()
+	// Snapshot so we don't hold the lock, or race a concurrent Subscribe,
+	// while sending to (potentially many) subscriber channels.
+	subs := make([]*eventSubscriber, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// ReplicateEvents is the process-wide bus every ReplicateClient
+// transaction publishes lifecycle events to.
+var ReplicateEvents = NewReplicateEventBus()
@@ -0,0 +1,165 @@
+package gazette
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// replicateClientProbeTimeout bounds how long the pool's reaper waits for
+// a liveness probe response from an otherwise-idle connection before
+// giving up and closing it.
+var replicateClientProbeTimeout = 5 * time.Second
+
+// ConnPoolStats is a point-in-time snapshot of a connPool's lifetime
+// counters, suitable for exporting to monitoring.
+type ConnPoolStats struct {
+	Opened      int64
+	Reused      int64
+	Evicted     int64
+	ProbeFailed int64
+}
+
+// connPool holds idle replicaClientConns for a single peer. Connections
+// are handed out on a best-effort basis via take/put; a background
+// reaper goroutine (started by NewReplicateClient) separately evicts
+// connections that have aged out or fail a liveness probe, since a
+// connection sitting unused for long stretches is the first place a
+// peer's restart or a NAT idle-timeout would otherwise go unnoticed.
+type connPool struct {
+	ch chan replicaClientConn
+
+	opened, reused, evicted, probeFailed int64
+}
+
+func newConnPool() *connPool {
+	return &connPool{ch: make(chan replicaClientConn, ReplicateClientIdlePoolSize)}
+}
+
+func (p *connPool) take() (replicaClientConn, bool) {
+	select {
+	case conn := <-p.ch:
+		return conn, true
+	default:
+		return replicaClientConn{}, false
+	}
+}
+
+func (p *connPool) put(conn replicaClientConn) {
+	select {
+	case p.ch <- conn:
+	default:
+		conn.raw.Close()
+	}
+}
+
+func (p *connPool) onOpened() { atomic.AddInt64(&p.opened, 1) }
+func (p *connPool) onReused() { atomic.AddInt64(&p.reused, 1) }
+
+func (p *connPool) stats() ConnPoolStats {
+	return ConnPoolStats{
+		Opened:      atomic.LoadInt64(&p.opened),
+		Reused:      atomic.LoadInt64(&p.reused),
+		Evicted:     atomic.LoadInt64(&p.evicted),
+		ProbeFailed: atomic.LoadInt64(&p.probeFailed),
+	}
+}
+
+// checkLive does a non-blocking SetReadDeadline(now) followed by a
+// one-byte peek-and-restore: a peer-initiated FIN surfaces as io.EOF from
+// the peek, which we catch here rather than mid-transaction on the first
+// write or ReadResponse. Peek doesn't consume the byte, so a healthy
+// connection is handed back exactly as it was found once the deadline is
+// cleared.
+func (p *connPool) checkLive(conn replicaClientConn) bool {
+	conn.raw.SetReadDeadline(time.Now())
+	_, err := conn.buf.Reader.Peek(1)
+	conn.raw.SetReadDeadline(time.Time{})
+
+	if err == nil {
+		// The peer sent unsolicited data on an otherwise-idle connection;
+		// we can't trust its framing state, so discard it.
+		conn.raw.Close()
+		atomic.AddInt64(&p.probeFailed, 1)
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true // No data waiting; connection appears healthy.
+	}
+	// EOF or some other read error: the peer closed or reset the connection.
+	conn.raw.Close()
+	atomic.AddInt64(&p.probeFailed, 1)
+	return false
+}
+
+// reap runs forever, periodically evicting connections that have been
+// idle longer than maxIdle and liveness-probing the rest. It's started
+// once per pool by NewReplicateClient.
+func (p *connPool) reap(maxIdle time.Duration) {
+	ticker := time.NewTicker(maxIdle / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.sweep(maxIdle)
+	}
+}
+
+func (p *connPool) sweep(maxIdle time.Duration) {
+	// Drain exactly the connections present at the start of this sweep,
+	// so we never spin on connections concurrently re-added by put().
+	for n := len(p.ch); n > 0; n-- {
+		var conn replicaClientConn
+		select {
+		case conn = <-p.ch:
+		default:
+			return
+		}
+
+		if time.Since(conn.idleSince) > maxIdle {
+			conn.raw.Close()
+			atomic.AddInt64(&p.evicted, 1)
+			continue
+		}
+		if !p.probe(conn) {
+			conn.raw.Close()
+			atomic.AddInt64(&p.evicted, 1)
+			atomic.AddInt64(&p.probeFailed, 1)
+			continue
+		}
+		select {
+		case p.ch <- conn:
+		default:
+			conn.raw.Close()
+			atomic.AddInt64(&p.evicted, 1)
+		}
+	}
+}
+
+// probe sends a lightweight liveness check (an OPTIONS request) on an
+// otherwise-idle connection, reporting failure if the peer doesn't
+// respond within replicateClientProbeTimeout. It doesn't close the
+// connection itself; sweep closes connections that fail the probe.
+func (p *connPool) probe(conn replicaClientConn) bool {
+	conn.raw.SetDeadline(time.Now().Add(replicateClientProbeTimeout))
+	// SetDeadline above sets both halves; clear both here too, or a stale
+	// write deadline is left in place and the connection's first real
+	// write after being handed back out fails with a spurious i/o timeout.
+	defer conn.raw.SetDeadline(time.Time{})
+
+	if _, err := conn.buf.WriteString("OPTIONS / HTTP/1.1\r\nHost: gazette\r\n\r\n"); err != nil {
+		return false
+	}
+	if err := conn.buf.Flush(); err != nil {
+		return false
+	}
+	resp, err := http.ReadResponse(conn.buf.Reader, nil)
+	if err != nil {
+		return false
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return true
+}
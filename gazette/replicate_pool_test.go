@@ -0,0 +1,69 @@
+package gazette
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestConnPoolProbeClearsWriteDeadline guards against a regression where
+// probe's deferred cleanup cleared only the read deadline it had set,
+// leaving a stale write deadline on the connection: the very next real
+// write performed by a caller that took the connection back out of the
+// pool would then fail immediately with a spurious i/o timeout.
+func TestConnPoolProbeClearsWriteDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for i := 0; i < 2; i++ {
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				return
+			}
+			req.Body.Close()
+			c.Write([]byte("HTTP/1.1 204 No Content\r\nContent-Length: 0\r\n\r\n"))
+		}
+	}()
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	conn := replicaClientConn{raw: raw, buf: bufio.NewReadWriter(bufio.NewReader(raw), bufio.NewWriter(raw))}
+
+	// Shorten the probe timeout so the test doesn't wait on the real
+	// default, then let it elapse before issuing a real write.
+	orig := replicateClientProbeTimeout
+	replicateClientProbeTimeout = 10 * time.Millisecond
+	defer func() { replicateClientProbeTimeout = orig }()
+
+	pool := newConnPool()
+	if !pool.probe(conn) {
+		t.Fatal("probe unexpectedly reported the connection dead")
+	}
+
+	time.Sleep(2 * replicateClientProbeTimeout)
+
+	// The regression was on |conn| itself, not a fresh dial: after probe
+	// returns, a real write on the same connection must not fail with a
+	// stale write deadline inherited from the probe.
+	if _, err := conn.buf.WriteString("OPTIONS / HTTP/1.1\r\nHost: gazette\r\n\r\n"); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	if err := conn.buf.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+}